@@ -0,0 +1,30 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// version, revision, and branch are populated at build time via
+// -ldflags "-X main.version=... -X main.revision=... -X main.branch=...".
+var (
+	version  = "unknown"
+	revision = "unknown"
+	branch   = "unknown"
+)
+
+// registerBuildInfo registers a pg_metrics_exporter_build_info gauge (value
+// 1) carrying the build's version/revision/branch/goversion as labels, the
+// conventional way Prometheus exporters expose their own build metadata.
+func registerBuildInfo(registry *prometheus.Registry) {
+	buildInfo := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pg_metrics_exporter_build_info",
+			Help: "A metric with a constant '1' value labeled by version, revision, branch, and goversion from which pg_metrics_exporter was built.",
+		},
+		[]string{"version", "revision", "branch", "goversion"},
+	)
+	buildInfo.WithLabelValues(version, revision, branch, runtime.Version()).Set(1)
+	registry.MustRegister(buildInfo)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// supportedAuthModuleTypes are the credential providers an AuthModule's
+// Type may select; each has its own dedicated field below. A type not in
+// this set is rejected at LoadConfig time rather than at probe time, so a
+// config file referencing an unimplemented provider (e.g. an AWS IAM
+// token, not supported yet) fails fast at startup instead of per-request.
+var supportedAuthModuleTypes = map[string]bool{
+	"userpass": true,
+	"env":      true,
+	"file":     true,
+}
+
+// AuthModule describes how to obtain credentials for a named auth module.
+// Only the field matching Type is consulted.
+type AuthModule struct {
+	Type string `yaml:"type"`
+
+	// UserPass is used verbatim when Type is "userpass".
+	UserPass struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"userpass,omitempty"`
+
+	// Env names the environment variables to read when Type is "env".
+	Env struct {
+		UsernameVar string `yaml:"username_var"`
+		PasswordVar string `yaml:"password_var"`
+	} `yaml:"env,omitempty"`
+
+	// File is consulted when Type is "file": Username is used verbatim
+	// and PasswordFile is read for the password.
+	File struct {
+		Username     string `yaml:"username"`
+		PasswordFile string `yaml:"password_file"`
+	} `yaml:"file,omitempty"`
+
+	// Options are additional libpq connection parameters (sslmode,
+	// connect_timeout, ...) merged on top of Config.DefaultConnOptions.
+	Options map[string]string `yaml:"options,omitempty"`
+}
+
+// Config is the top-level exporter configuration file format.
+type Config struct {
+	AuthModules map[string]*AuthModule `yaml:"auth_modules"`
+
+	// DefaultConnOptions are libpq connection parameters applied to every
+	// target unless overridden by the auth module's own Options.
+	DefaultConnOptions map[string]string `yaml:"default_conn_options"`
+}
+
+// LoadConfig reads and parses the YAML configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %s", err)
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing config file: %s", err)
+	}
+	for name, am := range cfg.AuthModules {
+		if am.Type == "" {
+			return nil, fmt.Errorf("auth module %q: type is required", name)
+		}
+		if !supportedAuthModuleTypes[am.Type] {
+			return nil, fmt.Errorf("auth module %q: unsupported type %q", name, am.Type)
+		}
+	}
+	return &cfg, nil
+}
+
+// credentials resolves the username/password for this auth module,
+// consulting the configured credential provider.
+func (am *AuthModule) credentials() (username, password string, err error) {
+	switch am.Type {
+	case "userpass":
+		return am.UserPass.Username, am.UserPass.Password, nil
+	case "env":
+		return os.Getenv(am.Env.UsernameVar), os.Getenv(am.Env.PasswordVar), nil
+	case "file":
+		data, err := ioutil.ReadFile(am.File.PasswordFile)
+		if err != nil {
+			return "", "", fmt.Errorf("reading credential file: %s", err)
+		}
+		return am.File.Username, strings.TrimSpace(string(data)), nil
+	default:
+		return "", "", fmt.Errorf("unknown auth module type %q", am.Type)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTempConfig(t *testing.T, contents string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("writing temp config: %s", err)
+	}
+	return path
+}
+
+func TestLoadConfigRejectsMissingType(t *testing.T) {
+	path := writeTempConfig(t, `
+auth_modules:
+  default:
+    userpass:
+      username: monitoring
+      password: s3cr3t
+`)
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("expected an error for an auth module missing type, got nil")
+	}
+}
+
+func TestLoadConfigRejectsUnsupportedType(t *testing.T) {
+	path := writeTempConfig(t, `
+auth_modules:
+  default:
+    type: aws-iam
+`)
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("expected an error for an unsupported auth module type, got nil")
+	}
+}
+
+func TestAuthModuleCredentialsEnv(t *testing.T) {
+	os.Setenv("PGM_TEST_USER", "monitoring")
+	os.Setenv("PGM_TEST_PASSWORD", "s3cr3t")
+	defer os.Unsetenv("PGM_TEST_USER")
+	defer os.Unsetenv("PGM_TEST_PASSWORD")
+
+	am := &AuthModule{Type: "env"}
+	am.Env.UsernameVar = "PGM_TEST_USER"
+	am.Env.PasswordVar = "PGM_TEST_PASSWORD"
+
+	username, password, err := am.credentials()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if username != "monitoring" || password != "s3cr3t" {
+		t.Errorf("credentials() = (%q, %q), want (%q, %q)", username, password, "monitoring", "s3cr3t")
+	}
+}
+
+func TestAuthModuleCredentialsFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(path, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatalf("writing password file: %s", err)
+	}
+
+	am := &AuthModule{Type: "file"}
+	am.File.Username = "monitoring"
+	am.File.PasswordFile = path
+
+	username, password, err := am.credentials()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if username != "monitoring" || password != "s3cr3t" {
+		t.Errorf("credentials() = (%q, %q), want (%q, %q)", username, password, "monitoring", "s3cr3t")
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// maxCachedTargets bounds dbCache: target and auth_module come straight
+// from request query params (__param_target/__param_auth_module, meant to
+// be relabel-friendly), so without a cap a client that varies the target
+// per request would grow the cache, and the per-target locks and error
+// counters alongside it, without bound.
+const maxCachedTargets = 1000
+
+// cachedTarget holds the per-target state that should outlive any single
+// /probe request: the pooled connection and its cumulative scrape-error
+// tally. lock serializes opening/healthchecking dbh so a probe against a
+// slow or unreachable target doesn't stall probes of unrelated targets.
+type cachedTarget struct {
+	key    string
+	lock   sync.Mutex
+	dbh    *sql.DB
+	errors *scrapeErrorCounters
+}
+
+// dbCache caches cachedTargets keyed by "target|auth_module" so that
+// repeated /probe requests against the same target don't pay the cost of
+// reconnecting every scrape, and so pg_exporter_scrape_errors_total keeps
+// counting across requests for that target. It's bounded to maxCachedTargets
+// entries, evicting the least-recently-used target once full.
+type dbCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newDBCache() *dbCache {
+	return &dbCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// entry returns the cachedTarget for key, creating one (and evicting the
+// least-recently-used entry if the cache is full) if it doesn't exist yet.
+func (c *dbCache) entry(key string) *cachedTarget {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		return el.Value.(*cachedTarget)
+	}
+
+	t := &cachedTarget{key: key, errors: newScrapeErrorCounters()}
+	c.entries[key] = c.lru.PushFront(t)
+
+	if c.lru.Len() > maxCachedTargets {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		evicted := oldest.Value.(*cachedTarget)
+		delete(c.entries, evicted.key)
+		if evicted.dbh != nil {
+			evicted.dbh.Close()
+		}
+	}
+
+	return t
+}
+
+func (c *dbCache) get(key string, open func() (*sql.DB, error)) (*cachedTarget, error) {
+	t := c.entry(key)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.dbh != nil {
+		if err := t.dbh.Ping(); err == nil {
+			return t, nil
+		}
+		t.dbh.Close()
+		t.dbh = nil
+	}
+
+	dbh, err := open()
+	if err != nil {
+		return nil, err
+	}
+	t.dbh = dbh
+	return t, nil
+}
+
+// buildDSN constructs a libpq connection string for target using the named
+// auth module and the config's default connection options.
+func buildDSN(cfg *Config, target, authModuleName string) (string, error) {
+	host, port, err := splitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+
+	am, ok := cfg.AuthModules[authModuleName]
+	if !ok {
+		return "", fmt.Errorf("unknown auth_module %q", authModuleName)
+	}
+	username, password, err := am.credentials()
+	if err != nil {
+		return "", fmt.Errorf("auth_module %q: %s", authModuleName, err)
+	}
+
+	options := make(map[string]string, len(cfg.DefaultConnOptions)+len(am.Options))
+	for k, v := range cfg.DefaultConnOptions {
+		options[k] = v
+	}
+	for k, v := range am.Options {
+		options[k] = v
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "host=%s port=%s user=%s password=%s", escapeDSNValue(host), escapeDSNValue(port), escapeDSNValue(username), escapeDSNValue(password))
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%s", k, escapeDSNValue(options[k]))
+	}
+	return b.String(), nil
+}
+
+func splitHostPort(target string) (host, port string, err error) {
+	idx := strings.LastIndex(target, ":")
+	if idx < 0 {
+		return "", "", fmt.Errorf("target %q must be host:port", target)
+	}
+	return target[:idx], target[idx+1:], nil
+}
+
+func escapeDSNValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
+// probeHandler implements the postgres_exporter-style /probe endpoint: it
+// opens (or reuses) a connection to the requested target, runs a one-shot
+// scrape against a fresh registry, and serves the result.
+type probeHandler struct {
+	elog       *log.Logger
+	cfg        *Config
+	schemaName string
+	cache      *dbCache
+}
+
+func newProbeHandler(elog *log.Logger, cfg *Config, schemaName string) *probeHandler {
+	return &probeHandler{
+		elog:       elog,
+		cfg:        cfg,
+		schemaName: schemaName,
+		cache:      newDBCache(),
+	}
+}
+
+func (h *probeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	target := params.Get("target")
+	if target == "" {
+		target = params.Get("__param_target")
+	}
+	if target == "" {
+		http.Error(w, "target parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	authModule := params.Get("auth_module")
+	if authModule == "" {
+		authModule = params.Get("__param_auth_module")
+	}
+	if authModule == "" {
+		authModule = "default"
+	}
+
+	dsn, err := buildDSN(h.cfg, target, authModule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cacheKey := target + "|" + authModule
+	cached, err := h.cache.get(cacheKey, func() (*sql.DB, error) {
+		dbh, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, err
+		}
+		dbh.SetMaxOpenConns(1)
+		dbh.SetMaxIdleConns(1)
+		if err := dbh.Ping(); err != nil {
+			dbh.Close()
+			return nil, err
+		}
+		return dbh, nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("connecting to %s: %s", target, err), http.StatusInternalServerError)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	refreshMetricListRequest := make(chan struct{}, 1)
+	collector, err := newPGMetricsCollector(h.elog, cached.dbh, h.schemaName, refreshMetricListRequest, cached.errors)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("probing %s: %s", target, err), http.StatusInternalServerError)
+		return
+	}
+	if err := registry.Register(collector); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorLog: h.elog, Registry: registry}).ServeHTTP(w, r)
+}
+
+// statusHandler serves a small status page listing the configured auth
+// modules, mirroring postgres_exporter's /config status page.
+func statusHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		names := make([]string, 0, len(cfg.AuthModules))
+		for name := range cfg.AuthModules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "Configured auth modules:\n")
+		for _, name := range names {
+			fmt.Fprintf(w, "  %s (type=%s)\n", name, cfg.AuthModules[name].Type)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDBCacheBoundsEntries(t *testing.T) {
+	c := newDBCache()
+	for i := 0; i < maxCachedTargets+10; i++ {
+		c.entry(fmt.Sprintf("target%d:5432|default", i))
+	}
+	if len(c.entries) != maxCachedTargets {
+		t.Errorf("len(entries) = %d, want %d", len(c.entries), maxCachedTargets)
+	}
+	if c.lru.Len() != maxCachedTargets {
+		t.Errorf("lru.Len() = %d, want %d", c.lru.Len(), maxCachedTargets)
+	}
+}
+
+func TestDBCacheEntryPersistsAcrossLookups(t *testing.T) {
+	c := newDBCache()
+	key := "db.example.com:5432|default"
+	first := c.entry(key)
+	first.errors.record("stats")
+
+	second := c.entry(key)
+	if second != first {
+		t.Fatal("entry() returned a different cachedTarget for the same key")
+	}
+	if got := second.errors.record("stats"); got != 2 {
+		t.Errorf("errors.record(\"stats\") = %v, want 2 (counter should persist across lookups)", got)
+	}
+}
+
+func TestEscapeDSNValue(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"simple", `'simple'`},
+		{`with'quote`, `'with\'quote'`},
+		{`with\backslash`, `'with\\backslash'`},
+		{"", "''"},
+	}
+	for _, c := range cases {
+		got := escapeDSNValue(c.in)
+		if got != c.want {
+			t.Errorf("escapeDSNValue(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	host, port, err := splitHostPort("db.example.com:5432")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if host != "db.example.com" || port != "5432" {
+		t.Errorf("got host=%q port=%q, want host=%q port=%q", host, port, "db.example.com", "5432")
+	}
+
+	if _, _, err := splitHostPort("no-port"); err == nil {
+		t.Error("expected an error for a target without a port, got nil")
+	}
+}
+
+func TestBuildDSN(t *testing.T) {
+	cfg := &Config{
+		AuthModules: map[string]*AuthModule{
+			"default": {
+				Type: "userpass",
+				UserPass: struct {
+					Username string `yaml:"username"`
+					Password string `yaml:"password"`
+				}{Username: "monitoring", Password: "s3cr3t"},
+				Options: map[string]string{"sslmode": "require"},
+			},
+		},
+		DefaultConnOptions: map[string]string{"connect_timeout": "5", "sslmode": "disable"},
+	}
+
+	dsn, err := buildDSN(cfg, "db.example.com:5432", "default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `host='db.example.com' port='5432' user='monitoring' password='s3cr3t' connect_timeout='5' sslmode='require'`
+	if dsn != want {
+		t.Errorf("buildDSN() = %q, want %q", dsn, want)
+	}
+
+	if _, err := buildDSN(cfg, "db.example.com:5432", "nonexistent"); err == nil {
+		t.Error("expected an error for an unknown auth module, got nil")
+	}
+}
@@ -2,14 +2,20 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"fmt"
+	kitlog "github.com/go-kit/log"
 	"github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 type PGMetricsCollector struct {
@@ -18,10 +24,68 @@ type PGMetricsCollector struct {
 	schemaName string
 
 	fetchQuery string
-	metrics map[string]PGMetric
+	descs map[metricKey]*prometheus.Desc
 	statsMetrics []*prometheus.Desc
+	upDesc *prometheus.Desc
+	scrapeErrorsDesc *prometheus.Desc
 
 	refreshMetricListRequest chan<- struct{}
+
+	// errorCounters outlives this collector instance: metricsListUpdaterLoop
+	// builds a new PGMetricsCollector on every metric-list refresh, and
+	// pg_exporter_scrape_errors_total must keep counting across those
+	// rebuilds rather than resetting to zero each time.
+	errorCounters *scrapeErrorCounters
+}
+
+// scrapeErrorCounters tallies scrape errors by stage across the lifetime of
+// whatever owns it (the metrics-list updater loop, or a single probed
+// target), independent of how many PGMetricsCollector instances are built
+// against it over time.
+type scrapeErrorCounters struct {
+	mu     sync.Mutex
+	counts map[string]float64
+}
+
+func newScrapeErrorCounters() *scrapeErrorCounters {
+	return &scrapeErrorCounters{counts: make(map[string]float64)}
+}
+
+// record increments the counter for stage and returns its new cumulative
+// value, following the conventional Prometheus exporter pattern of a
+// monotonically increasing scrape-errors-total counter.
+func (s *scrapeErrorCounters) record(stage string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[stage]++
+	return s.counts[stage]
+}
+
+// labelSetError is returned by fetchMetrics when the same metric name is
+// returned with more than one label-name set within a single scrape; it is
+// reported under the "describe" stage since it indicates the metric's
+// Desc cannot be determined unambiguously.
+type labelSetError struct {
+	metric string
+	a, b   string
+}
+
+func (e *labelSetError) Error() string {
+	return fmt.Sprintf("metric %q was returned with inconsistent label sets (%q vs %q) in the same scrape", e.metric, e.a, e.b)
+}
+
+// pairedArrayLengthError is returned by fetchMetrics when a histogram's or
+// summary's parallel arrays (bucket bounds/counts, quantiles/values) don't
+// have matching lengths, which would otherwise panic on a bad metrics()
+// row instead of being reported as an ordinary scrape error.
+type pairedArrayLengthError struct {
+	metric          string
+	field           string
+	wantLen, gotLen int
+}
+
+func (e *pairedArrayLengthError) Error() string {
+	return fmt.Sprintf("metric %q: %s has %d elements, want %d", e.metric, e.field, e.gotLen, e.wantLen)
 }
 
 type PGMetric struct {
@@ -33,6 +97,37 @@ type PGMetric struct {
 
 	// counters
 	CounterValue int64
+
+	// gauges
+	GaugeValue sql.NullFloat64
+
+	// histograms and summaries
+	Sum   sql.NullFloat64
+	Count sql.NullInt64
+
+	// histograms: HistogramBuckets[i] is the upper bound of the bucket
+	// whose cumulative count is HistogramCounts[i]
+	HistogramBuckets []float64
+	HistogramCounts  []int64
+
+	// summaries: Quantiles[i] (e.g. 0.5, 0.9, 0.99) maps to QuantileValues[i]
+	Quantiles      []float64
+	QuantileValues []float64
+
+	// labels: LabelNames[i] is the label key for LabelValues[i]
+	LabelNames  []string
+	LabelValues []string
+}
+
+// metricKey identifies a unique Desc: metrics sharing a name must also
+// share a label-name set, since a Desc's labels are fixed at registration.
+type metricKey struct {
+	Name          string
+	LabelNamesKey string
+}
+
+func newMetricKey(name string, labelNames []string) metricKey {
+	return metricKey{Name: name, LabelNamesKey: strings.Join(labelNames, ",")}
 }
 
 const (
@@ -40,91 +135,160 @@ const (
 	SKIP_DESCS = false
 )
 
-func (c *PGMetricsCollector) fetchMetrics(populateDescs bool) map[string]PGMetric {
-	metrics := make(map[string]PGMetric)
+func (c *PGMetricsCollector) fetchMetrics(populateDescs bool) ([]PGMetric, error) {
+	var metrics []PGMetric
+	labelNameSets := make(map[string]string)
 
 	rows, err := c.dbh.Query(c.fetchQuery)
 	if err != nil {
-		c.elog.Fatalf("ERROR:  %s", err)
+		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var metric PGMetric
 
-		err = rows.Scan(&metric.Name, &metric.Type, &metric.CounterValue)
+		err = rows.Scan(
+			&metric.Name,
+			&metric.Type,
+			&metric.CounterValue,
+			&metric.GaugeValue,
+			pq.Array(&metric.HistogramBuckets),
+			pq.Array(&metric.HistogramCounts),
+			&metric.Sum,
+			&metric.Count,
+			pq.Array(&metric.Quantiles),
+			pq.Array(&metric.QuantileValues),
+			pq.Array(&metric.LabelNames),
+			pq.Array(&metric.LabelValues),
+		)
 		if err != nil {
-			c.elog.Fatalf("ERROR:  %s", err)
+			return nil, err
+		}
+		if len(metric.HistogramCounts) != len(metric.HistogramBuckets) {
+			return nil, &pairedArrayLengthError{
+				metric: metric.Name, field: "histogram_counts",
+				wantLen: len(metric.HistogramBuckets), gotLen: len(metric.HistogramCounts),
+			}
+		}
+		if len(metric.QuantileValues) != len(metric.Quantiles) {
+			return nil, &pairedArrayLengthError{
+				metric: metric.Name, field: "quantile_values",
+				wantLen: len(metric.Quantiles), gotLen: len(metric.QuantileValues),
+			}
+		}
+
+		labelNamesKey := strings.Join(metric.LabelNames, ",")
+		if existing, seen := labelNameSets[metric.Name]; seen {
+			if existing != labelNamesKey {
+				return nil, &labelSetError{metric: metric.Name, a: existing, b: labelNamesKey}
+			}
+		} else {
+			labelNameSets[metric.Name] = labelNamesKey
 		}
 		if populateDescs {
 			metric.Desc = prometheus.NewDesc(
 				metric.Name,
 				metric.Name + " " + strings.ToLower(metric.Type),
-				nil,
+				metric.LabelNames,
 				nil,
 			)
 		}
-		metrics[metric.Name] = metric
+		metrics = append(metrics, metric)
 	}
 	if rows.Err() != nil {
-		c.elog.Fatalf("ERROR:  %s", rows.Err())
+		return nil, rows.Err()
 	}
-	return metrics
+	return metrics, nil
 }
 
 func (c *PGMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
 	for _, desc := range c.statsMetrics {
 		ch <- desc
 	}
-	for _, metric := range c.metrics {
-		ch <- metric.Desc
+	for _, desc := range c.descs {
+		ch <- desc
 	}
+	ch <- c.upDesc
+	ch <- c.scrapeErrorsDesc
 }
 
-func (c *PGMetricsCollector) fetchStats() (maxMetrics int32, numMetrics int32) {
+func (c *PGMetricsCollector) fetchStats() (maxMetrics int32, numMetrics int32, err error) {
 	statsQuery := fmt.Sprintf(`SELECT max_metrics, num_metrics FROM %s.metrics_stats()`, pq.QuoteIdentifier(c.schemaName))
-	err := c.dbh.QueryRow(statsQuery).Scan(&maxMetrics, &numMetrics)
-	if err != nil {
-		c.elog.Fatalf("ERROR:  %s", err)
-	}
-	return maxMetrics, numMetrics
+	err = c.dbh.QueryRow(statsQuery).Scan(&maxMetrics, &numMetrics)
+	return maxMetrics, numMetrics, err
 }
 
-
 func (c *PGMetricsCollector) Collect(ch chan<- prometheus.Metric) {
-	maxMetrics, numMetrics := c.fetchStats()
-	ch <- prometheus.MustNewConstMetric(c.statsMetrics[0], prometheus.GaugeValue, float64(maxMetrics))
-	ch <- prometheus.MustNewConstMetric(c.statsMetrics[1], prometheus.GaugeValue, float64(numMetrics))
+	up := 1.0
 
-	metrics := c.fetchMetrics(SKIP_DESCS)
-	needRefresh := false
-	for _, metric := range metrics {
-		x, exists := c.metrics[metric.Name]
-		if !exists {
-			needRefresh = true
-			continue
-		}
-		desc := x.Desc
+	maxMetrics, numMetrics, err := c.fetchStats()
+	if err != nil {
+		c.elog.Printf("ERROR:  %s", err)
+		ch <- prometheus.MustNewConstMetric(c.scrapeErrorsDesc, prometheus.CounterValue, c.errorCounters.record("stats"), "stats")
+		up = 0
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.statsMetrics[0], prometheus.GaugeValue, float64(maxMetrics))
+		ch <- prometheus.MustNewConstMetric(c.statsMetrics[1], prometheus.GaugeValue, float64(numMetrics))
+	}
 
-		switch metric.Type {
-		case "COUNTER":
-			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(metric.CounterValue))
-		default:
-			panic(fmt.Sprintf("unexpected metric type %s", metric.Type))
+	metrics, err := c.fetchMetrics(SKIP_DESCS)
+	if err != nil {
+		stage := "metrics"
+		switch err.(type) {
+		case *labelSetError, *pairedArrayLengthError:
+			stage = "describe"
 		}
-	}
+		c.elog.Printf("ERROR:  %s", err)
+		ch <- prometheus.MustNewConstMetric(c.scrapeErrorsDesc, prometheus.CounterValue, c.errorCounters.record(stage), stage)
+		up = 0
+	} else {
+		needRefresh := false
+		for _, metric := range metrics {
+			desc, exists := c.descs[newMetricKey(metric.Name, metric.LabelNames)]
+			if !exists {
+				needRefresh = true
+				continue
+			}
 
-	if needRefresh {
-		select {
-			case c.refreshMetricListRequest <- struct{}{}:
+			switch metric.Type {
+			case "COUNTER":
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(metric.CounterValue), metric.LabelValues...)
+			case "GAUGE":
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, metric.GaugeValue.Float64, metric.LabelValues...)
+			case "HISTOGRAM":
+				buckets := make(map[float64]uint64, len(metric.HistogramBuckets))
+				for i, bound := range metric.HistogramBuckets {
+					buckets[bound] = uint64(metric.HistogramCounts[i])
+				}
+				ch <- prometheus.MustNewConstHistogram(desc, uint64(metric.Count.Int64), metric.Sum.Float64, buckets, metric.LabelValues...)
+			case "SUMMARY":
+				quantiles := make(map[float64]float64, len(metric.Quantiles))
+				for i, q := range metric.Quantiles {
+					quantiles[q] = metric.QuantileValues[i]
+				}
+				ch <- prometheus.MustNewConstSummary(desc, uint64(metric.Count.Int64), metric.Sum.Float64, quantiles, metric.LabelValues...)
 			default:
+				panic(fmt.Sprintf("unexpected metric type %s", metric.Type))
+			}
+		}
+
+		if needRefresh {
+			select {
+				case c.refreshMetricListRequest <- struct{}{}:
+				default:
+			}
 		}
 	}
+
+	ch <- prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, up)
 }
 
-func newPGMetricsCollector(elog *log.Logger, dbh *sql.DB, schemaName string, refreshMetricListRequest chan<- struct{}) *PGMetricsCollector {
+func newPGMetricsCollector(elog *log.Logger, dbh *sql.DB, schemaName string, refreshMetricListRequest chan<- struct{}, errorCounters *scrapeErrorCounters) (*PGMetricsCollector, error) {
 	fetchQuery := fmt.Sprintf(
 		`SELECT ` +
-		`metric_name, metric_type, counter_value ` +
+		`metric_name, metric_type, counter_value, gauge_value, ` +
+		`histogram_buckets, histogram_counts, sum, count, ` +
+		`quantiles, quantile_values, label_names, label_values ` +
 		`FROM %s.metrics()`,
 		pq.QuoteIdentifier(schemaName),
 	)
@@ -134,33 +298,67 @@ func newPGMetricsCollector(elog *log.Logger, dbh *sql.DB, schemaName string, ref
 		schemaName: schemaName,
 		fetchQuery: fetchQuery,
 		refreshMetricListRequest: refreshMetricListRequest,
+		errorCounters: errorCounters,
+	}
+	metrics, err := c.fetchMetrics(POPULATE_DESCS)
+	if err != nil {
+		return nil, err
+	}
+	c.descs = make(map[metricKey]*prometheus.Desc)
+	for _, metric := range metrics {
+		c.descs[newMetricKey(metric.Name, metric.LabelNames)] = metric.Desc
 	}
-	c.metrics = c.fetchMetrics(POPULATE_DESCS)
 	c.statsMetrics = []*prometheus.Desc{
 		prometheus.NewDesc(
 			"max_metrics",
-			"tu-turu",
+			"Maximum number of metrics the metrics schema can track",
 			nil,
 			nil,
 		),
 		prometheus.NewDesc(
 			"num_metrics",
-			"tu-turu",
+			"Current number of metrics tracked by the metrics schema",
 			nil,
 			nil,
 		),
 	}
+	c.upDesc = prometheus.NewDesc(
+		"pg_up",
+		"Whether the last scrape of the Postgres instance was successful",
+		nil,
+		nil,
+	)
+	c.scrapeErrorsDesc = prometheus.NewDesc(
+		"pg_exporter_scrape_errors_total",
+		"Total number of scrape errors, by stage",
+		[]string{"stage"},
+		nil,
+	)
 
-	return c
+	return c, nil
 }
 
+// metricsListUpdaterLoop keeps a PGMetricsCollector registered against
+// registry, rebuilding it whenever the collector asks for a metric-list
+// refresh or the initial query fails (e.g. because of a DB restart,
+// failover, or schema reload). It never exits the process on its own: a
+// connection hiccup is retried with a fixed backoff.
 func metricsListUpdaterLoop(elog *log.Logger, dbh *sql.DB, schemaName string, registry *prometheus.Registry) {
+	const retryInterval = 5 * time.Second
+	errorCounters := newScrapeErrorCounters()
 	for {
 		refreshMetricListRequest := make(chan struct{}, 1)
-		collector := newPGMetricsCollector(elog, dbh, schemaName, refreshMetricListRequest)
-		err := registry.Register(collector)
+		collector, err := newPGMetricsCollector(elog, dbh, schemaName, refreshMetricListRequest, errorCounters)
 		if err != nil {
-			elog.Fatalf("ERROR:  %s", err)
+			elog.Printf("ERROR:  %s; retrying in %s", err, retryInterval)
+			time.Sleep(retryInterval)
+			continue
+		}
+		err = registry.Register(collector)
+		if err != nil {
+			elog.Printf("ERROR:  %s; retrying in %s", err, retryInterval)
+			time.Sleep(retryInterval)
+			continue
 		}
 		<-refreshMetricListRequest
 		elog.Printf("Refreshing the list of metrics")
@@ -169,28 +367,65 @@ func metricsListUpdaterLoop(elog *log.Logger, dbh *sql.DB, schemaName string, re
 }
 
 func main() {
+	configFile := flag.String("config.file", "", "Path to the exporter config file (auth modules for /probe). If unset, only /metrics against the process's own DSN is served.")
+	listenAddress := flag.String("web.listen-address", ":8080", "Address to listen on.")
+	webConfigFile := flag.String("web.config.file", "", "Path to an exporter-toolkit web config file (TLS cert/key, client CA, basic auth users).")
+	telemetryPath := flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	flag.Parse()
+
 	elog := log.New(os.Stderr, "", log.LstdFlags)
 	schemaName := "metrics"
 
-	dbh, err := sql.Open("postgres", "")
-	if err != nil {
-		elog.Fatal(err)
-	}
-	dbh.SetMaxOpenConns(1)
-	dbh.SetMaxIdleConns(1)
-	err = dbh.Ping()
-	if err != nil {
-		elog.Fatal(err)
-	}
-
 	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{Namespace: "pg_metrics_exporter"}))
+	registry.MustRegister(collectors.NewGoCollector())
+	registerBuildInfo(registry)
+
 	httpHandler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{
 		ErrorLog: elog,
+		Registry: registry,
 	})
-	http.Handle("/metrics", httpHandler)
+	http.Handle(*telemetryPath, httpHandler)
+
+	var cfg *Config
+	if *configFile != "" {
+		var err error
+		cfg, err = LoadConfig(*configFile)
+		if err != nil {
+			elog.Fatalf("ERROR:  %s", err)
+		}
+		http.Handle("/probe", newProbeHandler(elog, cfg, schemaName))
+		http.Handle("/config", statusHandler(cfg))
+	}
+
+	server := &http.Server{}
+	flagConfig := &web.FlagConfig{
+		WebListenAddresses: &[]string{*listenAddress},
+		WebSystemdSocket:   new(bool),
+		WebConfigFile:      webConfigFile,
+	}
+	kitLogger := kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(os.Stderr))
 	go func() {
-		elog.Fatal(http.ListenAndServe(":8080", nil))
+		elog.Fatal(web.ListenAndServe(server, flagConfig, kitLogger))
 	}()
 
+	// The default single-target DSN (the process's own PG* libpq env
+	// vars) is optional: a daemon deployed purely for /probe-style
+	// multi-target scraping has no such target, and --config.file alone
+	// must be enough to start successfully.
+	dbh, err := sql.Open("postgres", "")
+	if err == nil {
+		dbh.SetMaxOpenConns(1)
+		dbh.SetMaxIdleConns(1)
+		err = dbh.Ping()
+	}
+	if err != nil {
+		if cfg == nil {
+			elog.Fatal(err)
+		}
+		elog.Printf("WARNING:  default target unavailable (%s); serving /probe and exporter self-metrics only", err)
+		select {}
+	}
+
 	metricsListUpdaterLoop(elog, dbh, schemaName, registry)
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+)
+
+// fakeMetricsRows is a minimal database/sql/driver fake that returns a
+// fixed set of rows for any query, so fetchMetrics's label-set-consistency
+// check can be exercised without a real Postgres connection.
+type fakeMetricsRows [][]driver.Value
+
+var fakeMetricsColumns = []string{
+	"metric_name", "metric_type", "counter_value", "gauge_value",
+	"histogram_buckets", "histogram_counts", "sum", "count",
+	"quantiles", "quantile_values", "label_names", "label_values",
+}
+
+type fakeDriver struct{ rows fakeMetricsRows }
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) { return &fakeConn{rows: d.rows}, nil }
+
+type fakeConn struct{ rows fakeMetricsRows }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+func (c *fakeConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return &fakeRows{rows: c.rows}, nil
+}
+
+type fakeRows struct {
+	rows fakeMetricsRows
+	pos  int
+}
+
+func (r *fakeRows) Columns() []string { return fakeMetricsColumns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.pos])
+	r.pos++
+	return nil
+}
+
+var fakeDriverSeq int
+
+func registerFakeMetricsDB(t *testing.T, rows fakeMetricsRows) *sql.DB {
+	t.Helper()
+	fakeDriverSeq++
+	name := fmt.Sprintf("fakemetrics%d", fakeDriverSeq)
+	sql.Register(name, &fakeDriver{rows: rows})
+	dbh, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatalf("sql.Open: %s", err)
+	}
+	return dbh
+}
+
+func newTestCollector(dbh *sql.DB) *PGMetricsCollector {
+	return &PGMetricsCollector{
+		elog:       log.New(io.Discard, "", 0),
+		dbh:        dbh,
+		schemaName: "metrics",
+		fetchQuery: "SELECT * FROM metrics()",
+	}
+}
+
+func TestFetchMetricsConsistentLabelSets(t *testing.T) {
+	rows := fakeMetricsRows{
+		{"http_requests", "COUNTER", int64(1), nil, "{}", "{}", nil, nil, "{}", "{}", "{method}", "{GET}"},
+		{"http_requests", "COUNTER", int64(2), nil, "{}", "{}", nil, nil, "{}", "{}", "{method}", "{POST}"},
+	}
+	c := newTestCollector(registerFakeMetricsDB(t, rows))
+
+	metrics, err := c.fetchMetrics(SKIP_DESCS)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("got %d metrics, want 2", len(metrics))
+	}
+}
+
+func TestFetchMetricsMismatchedHistogramArrays(t *testing.T) {
+	rows := fakeMetricsRows{
+		{"request_latency", "HISTOGRAM", int64(0), nil, "{0.1,0.5}", "{3}", 1.2, int64(3), "{}", "{}", "{}", "{}"},
+	}
+	c := newTestCollector(registerFakeMetricsDB(t, rows))
+
+	_, err := c.fetchMetrics(SKIP_DESCS)
+	if err == nil {
+		t.Fatal("expected an error for mismatched histogram array lengths, got nil")
+	}
+	var palErr *pairedArrayLengthError
+	if !errors.As(err, &palErr) {
+		t.Fatalf("got error %T (%v), want *pairedArrayLengthError", err, err)
+	}
+	if palErr.field != "histogram_counts" {
+		t.Errorf("pairedArrayLengthError.field = %q, want %q", palErr.field, "histogram_counts")
+	}
+}
+
+func TestFetchMetricsInconsistentLabelSets(t *testing.T) {
+	rows := fakeMetricsRows{
+		{"http_requests", "COUNTER", int64(1), nil, "{}", "{}", nil, nil, "{}", "{}", "{method}", "{GET}"},
+		{"http_requests", "COUNTER", int64(2), nil, "{}", "{}", nil, nil, "{}", "{}", "{method,code}", "{GET,200}"},
+	}
+	c := newTestCollector(registerFakeMetricsDB(t, rows))
+
+	_, err := c.fetchMetrics(SKIP_DESCS)
+	if err == nil {
+		t.Fatal("expected an error for inconsistent label sets, got nil")
+	}
+	var lsErr *labelSetError
+	if !errors.As(err, &lsErr) {
+		t.Fatalf("got error %T (%v), want *labelSetError", err, err)
+	}
+	if lsErr.metric != "http_requests" {
+		t.Errorf("labelSetError.metric = %q, want %q", lsErr.metric, "http_requests")
+	}
+}